@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// AssetRecord is what we remember about a downloaded attachment so a later
+// re-send of the same origin attachment can skip hitting the origin URL
+// again. This is a flat JSON index rather than a bolt/sqlite database - a
+// deliberate simplification, since the volume here (one record per
+// downloaded attachment) doesn't warrant a real database and the rest of
+// the service already persists its state the same way (see
+// DiscordServiceConfiguration's config.<INSTANCE_ID>.json). It also omits
+// width/height: client.AttachmentInput has nowhere to put them, so there's
+// nothing downstream that would consume them yet.
+type AssetRecord struct {
+	OriginID    string `json:"origin_id"`
+	LocalPath   string `json:"local_path"`
+	ContentType string `json:"content_type"`
+	Checksum    string `json:"checksum"`
+}
+
+// AssetStore persists downloaded attachments under a directory, indexed by
+// the ChatPlug/Discord attachment ID they came from.
+type AssetStore struct {
+	mu        sync.Mutex
+	dir       string
+	indexPath string
+	records   map[string]AssetRecord
+}
+
+// NewAssetStore opens (creating if necessary) an asset store rooted at
+// dir, loading its existing index if present.
+func NewAssetStore(dir string) (*AssetStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	store := &AssetStore{
+		dir:       dir,
+		indexPath: filepath.Join(dir, "index.json"),
+		records:   make(map[string]AssetRecord),
+	}
+
+	file, err := ioutil.ReadFile(store.indexPath)
+	if err != nil {
+		return store, nil
+	}
+
+	if err := json.Unmarshal(file, &store.records); err != nil {
+		return store, nil
+	}
+
+	return store, nil
+}
+
+// Dir returns the directory assets are stored under.
+func (s *AssetStore) Dir() string {
+	return s.dir
+}
+
+// Lookup returns the record for a previously downloaded attachment, if
+// one was recorded and its file still exists.
+func (s *AssetStore) Lookup(originID string) (AssetRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[originID]
+	if !ok {
+		return AssetRecord{}, false
+	}
+
+	if _, err := os.Stat(record.LocalPath); err != nil {
+		return AssetRecord{}, false
+	}
+
+	return record, true
+}
+
+// Put records a newly downloaded attachment and persists the index.
+func (s *AssetStore) Put(record AssetRecord) {
+	s.mu.Lock()
+	s.records[record.OriginID] = record
+	s.mu.Unlock()
+
+	s.save()
+}
+
+func (s *AssetStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := json.MarshalIndent(s.records, "", " ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(s.indexPath, file, 0644)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	client "github.com/ChatPlug/client-go"
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordMentionPattern matches <@id>, <@!id>, <@&roleID>, and <#channelID>.
+var discordMentionPattern = regexp.MustCompile(`<(@!?|@&|#)(\d+)>`)
+
+// discordEmojiPattern matches <:name:id> and <a:name:id> custom emoji.
+var discordEmojiPattern = regexp.MustCompile(`<(a?):(\w+):(\d+)>`)
+
+// chatPlugMentionPattern matches the "@name" mentions ChatPlug sends us,
+// which we turn back into Discord mentions on the way out.
+var chatPlugMentionPattern = regexp.MustCompile(`@([\w.]+)`)
+
+// resolveDiscordContent rewrites Discord-specific mention and custom emoji
+// tokens in content into the human-readable form ChatPlug expects,
+// returning any attachments the tokens imply (custom emoji images).
+func (ds *DiscordService) resolveDiscordContent(guildID, content string) (string, []*client.AttachmentInput) {
+	attachments := make([]*client.AttachmentInput, 0)
+
+	content = discordMentionPattern.ReplaceAllStringFunc(content, func(token string) string {
+		match := discordMentionPattern.FindStringSubmatch(token)
+		kind, id := match[1], match[2]
+
+		switch kind {
+		case "@", "@!":
+			if member, err := ds.discordClient.State.Member(guildID, id); err == nil {
+				return "@" + member.User.Username
+			}
+			if user, err := ds.discordClient.User(id); err == nil {
+				return "@" + user.Username
+			}
+		case "@&":
+			if role, err := ds.discordClient.State.Role(guildID, id); err == nil {
+				return "@" + role.Name
+			}
+		case "#":
+			if channel, err := ds.discordClient.State.Channel(id); err == nil {
+				return "#" + channel.Name
+			}
+		}
+
+		return token
+	})
+
+	content = discordEmojiPattern.ReplaceAllStringFunc(content, func(token string) string {
+		match := discordEmojiPattern.FindStringSubmatch(token)
+		animated, name, id := match[1] == "a", match[2], match[3]
+
+		ext := "png"
+		if animated {
+			ext = "gif"
+		}
+
+		attachments = append(attachments, &client.AttachmentInput{
+			Type:      "IMAGE",
+			OriginID:  id,
+			SourceURL: fmt.Sprintf("https://cdn.discordapp.com/emojis/%s.%s", id, ext),
+		})
+
+		return ":" + name + ":"
+	})
+
+	return content, attachments
+}
+
+// rewriteMentionsForDiscord turns the "@name" mentions ChatPlug sends into
+// <@id> Discord mentions, using the member maps populated from
+// GuildMembersChunk events. Names that don't resolve to a known member are
+// left untouched.
+func (ds *DiscordService) rewriteMentionsForDiscord(content string) string {
+	ds.memberMapMu.Lock()
+	defer ds.memberMapMu.Unlock()
+
+	return chatPlugMentionPattern.ReplaceAllStringFunc(content, func(token string) string {
+		name := token[1:]
+
+		if member, ok := ds.nickMemberMap[name]; ok {
+			return "<@" + member.User.ID + ">"
+		}
+		if member, ok := ds.userMemberMap[name]; ok {
+			return "<@" + member.User.ID + ">"
+		}
+
+		return token
+	})
+}
+
+// renderEmbeds turns Discord embeds into a textual excerpt plus any
+// image/video attachments they carry, since ChatPlug has no native concept
+// of an embed.
+func renderEmbeds(embeds []*discordgo.MessageEmbed) (string, []*client.AttachmentInput) {
+	var text strings.Builder
+	attachments := make([]*client.AttachmentInput, 0)
+
+	for _, embed := range embeds {
+		if embed.Title != "" {
+			fmt.Fprintf(&text, "\n**%s**", embed.Title)
+		}
+		if embed.Description != "" {
+			fmt.Fprintf(&text, "\n%s", embed.Description)
+		}
+		for _, field := range embed.Fields {
+			fmt.Fprintf(&text, "\n**%s**\n%s", field.Name, field.Value)
+		}
+
+		if embed.Image != nil && embed.Image.URL != "" {
+			attachments = append(attachments, &client.AttachmentInput{
+				Type:      "IMAGE",
+				OriginID:  embed.Image.URL,
+				SourceURL: embed.Image.URL,
+			})
+		}
+		if embed.Thumbnail != nil && embed.Thumbnail.URL != "" {
+			attachments = append(attachments, &client.AttachmentInput{
+				Type:      "IMAGE",
+				OriginID:  embed.Thumbnail.URL,
+				SourceURL: embed.Thumbnail.URL,
+			})
+		}
+		if embed.Video != nil && embed.Video.URL != "" {
+			attachments = append(attachments, &client.AttachmentInput{
+				Type:      "VIDEO",
+				OriginID:  embed.Video.URL,
+				SourceURL: embed.Video.URL,
+			})
+		}
+	}
+
+	return text.String(), attachments
+}
+
+// quotedReplyPrefix fetches the message m is replying to, if any, and
+// renders it as a short quoted excerpt to prepend to m's content.
+func (ds *DiscordService) quotedReplyPrefix(m *discordgo.MessageCreate) string {
+	if m.MessageReference == nil {
+		return ""
+	}
+
+	referenced, err := ds.discordClient.ChannelMessage(m.MessageReference.ChannelID, m.MessageReference.MessageID)
+	if err != nil || referenced == nil {
+		return ""
+	}
+
+	excerpt := referenced.Content
+	if runes := []rune(excerpt); len(runes) > 80 {
+		excerpt = string(runes[:80]) + "…"
+	}
+
+	return fmt.Sprintf("> **%s**: %s\n", referenced.Author.Username, excerpt)
+}
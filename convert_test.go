@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRenderEmbedsText(t *testing.T) {
+	embeds := []*discordgo.MessageEmbed{
+		{
+			Title:       "Release notes",
+			Description: "Things changed.",
+			Fields: []*discordgo.MessageEmbedField{
+				{Name: "Version", Value: "1.2.3"},
+			},
+		},
+	}
+
+	text, attachments := renderEmbeds(embeds)
+
+	for _, want := range []string{"**Release notes**", "Things changed.", "**Version**", "1.2.3"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("rendered text %q does not contain %q", text, want)
+		}
+	}
+	if len(attachments) != 0 {
+		t.Errorf("expected no attachments for a text-only embed, got %d", len(attachments))
+	}
+}
+
+func TestRenderEmbedsPromotesMedia(t *testing.T) {
+	embeds := []*discordgo.MessageEmbed{
+		{
+			Image:     &discordgo.MessageEmbedImage{URL: "https://cdn.example/image.png"},
+			Thumbnail: &discordgo.MessageEmbedThumbnail{URL: "https://cdn.example/thumb.png"},
+			Video:     &discordgo.MessageEmbedVideo{URL: "https://cdn.example/video.mp4"},
+		},
+	}
+
+	_, attachments := renderEmbeds(embeds)
+
+	if len(attachments) != 3 {
+		t.Fatalf("len(attachments) = %d; want 3", len(attachments))
+	}
+
+	byURL := make(map[string]string)
+	for _, a := range attachments {
+		byURL[a.SourceURL] = a.Type
+	}
+
+	if byURL["https://cdn.example/image.png"] != "IMAGE" {
+		t.Errorf("image attachment type = %q; want IMAGE", byURL["https://cdn.example/image.png"])
+	}
+	if byURL["https://cdn.example/thumb.png"] != "IMAGE" {
+		t.Errorf("thumbnail attachment type = %q; want IMAGE", byURL["https://cdn.example/thumb.png"])
+	}
+	if byURL["https://cdn.example/video.mp4"] != "VIDEO" {
+		t.Errorf("video attachment type = %q; want VIDEO", byURL["https://cdn.example/video.mp4"])
+	}
+}
+
+func TestRenderEmbedsEmpty(t *testing.T) {
+	text, attachments := renderEmbeds(nil)
+
+	if text != "" {
+		t.Errorf("text = %q; want empty", text)
+	}
+	if len(attachments) != 0 {
+		t.Errorf("len(attachments) = %d; want 0", len(attachments))
+	}
+}
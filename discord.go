@@ -1,124 +1,196 @@
+// STATUS: ChatPlug/discord-service#chunk0-1 (message edit/delete sync) is
+// parked, not resolved. It was attempted in 5ee4f5c and reverted in
+// 277076f because the pinned client-go exposes no subscription or
+// mutation for edits/deletes (see handleMessages). Re-attempt once a
+// companion client-go change adds that surface; until then there is no
+// message-edit/delete handling in either direction.
 package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	client "github.com/ChatPlug/client-go"
+	"github.com/ChatPlug/discord-service/transmitter"
 	"github.com/bwmarrin/discordgo"
 )
 
 type DiscordService struct {
 	client        *client.ChatPlugClient
 	discordClient *discordgo.Session
+	transmitter   *transmitter.Transmitter
+	assetStore    *AssetStore
+
+	memberMapMu   sync.Mutex
+	userMemberMap map[string]*discordgo.Member
+	nickMemberMap map[string]*discordgo.Member
+
+	allowedGuildIDs  map[string]bool
+	suppressJoinPart bool
+}
+
+// guildAllowed reports whether guildID may be bridged. An empty allowlist
+// means every guild is allowed.
+func (ds *DiscordService) guildAllowed(guildID string) bool {
+	if len(ds.allowedGuildIDs) == 0 {
+		return true
+	}
+	return ds.allowedGuildIDs[guildID]
+}
+
+func parseGuildIDs(raw string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, id := range strings.Split(raw, ",") {
+		id = strings.TrimSpace(id)
+		if id != "" {
+			ids[id] = true
+		}
+	}
+	return ids
 }
 
-type WebhookPayload struct {
-	Content   string `json:"content"`
-	Username  string `json:"username"`
-	AvatarURL string `json:"avatar_url"`
+// isJoinPartMessage reports whether t is the type of Discord's own "member
+// joined" system message, rather than of user content. Discord has no
+// equivalent native message for a member leaving.
+func isJoinPartMessage(t discordgo.MessageType) bool {
+	return t == discordgo.MessageTypeGuildMemberJoin
 }
 
 type DiscordServiceConfiguration struct {
 	BotToken string `json:"botToken"`
+
+	// WebhookURL lets an operator who can't grant the bot "Manage
+	// Webhooks" pre-create a webhook and have the service post to it
+	// directly. ThreadWebhookURLs overrides WebhookURL per target thread
+	// (channel) ID; it isn't exposed in the configuration wizard and is
+	// meant to be hand-edited into the config file.
+	WebhookURL        string            `json:"webhookURL"`
+	ThreadWebhookURLs map[string]string `json:"threadWebhookURLs"`
+
+	// GuildIDs, if non-empty, restricts the bridge to a comma-separated
+	// allowlist of guilds - useful for a bot that lives in many servers
+	// but should only bridge a couple of them. SuppressJoinPart drops
+	// Discord's own member join/leave system messages instead of
+	// forwarding them.
+	GuildIDs         string `json:"guildIDs"`
+	SuppressJoinPart bool   `json:"suppressJoinPart"`
+
+	// StorageDir, if set, persists downloaded attachments to disk keyed by
+	// checksum so a re-sent attachment (e.g. a bridged edit) can skip the
+	// re-download.
+	StorageDir string `json:"storageDir"`
 }
 
+// handleMessages relays ChatPlug messages into Discord. The pinned
+// client-go (github.com/ChatPlug/client-go@v0.0.0-20190818193312-244d82e0d02b)
+// only exposes MessagesChan - it has no subscription for message edits or
+// deletions, and no mutation to push a Discord-side edit/delete back to
+// ChatPlug - so those can't be synced across the bridge until a companion
+// client-go change adds that surface.
 func (ds *DiscordService) handleMessages() {
-
 	for msg := range ds.client.MessagesChan {
-		webhooks, _ := ds.discordClient.ChannelWebhooks(msg.TargetThreadID)
-
-		hasWebhook := false
-		var webhook *discordgo.Webhook
+		ds.sendDiscordMessage(msg)
+	}
+}
 
-		for _, hook := range webhooks {
-			if strings.HasPrefix(hook.Name, "ChatPlug ") {
-				hasWebhook = true
-				webhook = hook
-			}
-		}
+func (ds *DiscordService) sendDiscordMessage(msg *client.MessageReceived) {
+	files := make([]*transmitter.File, 0, len(msg.Message.Attachments))
 
-		if !hasWebhook {
-			channel, _ := ds.discordClient.Channel(msg.TargetThreadID)
-			webhook, _ = ds.discordClient.WebhookCreate(msg.TargetThreadID, "ChatPlug "+channel.Name, "https://i.imgur.com/l2QP9Go.png")
+	for _, attachment := range msg.Message.Attachments {
+		file, err := ds.fetchAttachment(attachment.OriginID, attachment.SourceURL)
+		if err != nil {
+			fmt.Println(err)
+			continue
 		}
 
-		url := fmt.Sprintf("https://discordapp.com/api/webhooks/%s/%s", webhook.ID, webhook.Token)
-		payload, _ := json.Marshal(&WebhookPayload{
-			Username:  msg.Message.Author.Username,
-			AvatarURL: msg.Message.Author.AvatarURL,
-			Content:   msg.Message.Body,
-		})
-
-		fmt.Println("Sending a message to the webhook")
+		files = append(files, file)
+	}
 
-		// http://polyglot.ninja/golang-making-http-requests/
-		var body bytes.Buffer
-		writer := multipart.NewWriter(&body)
+	if _, err := ds.transmitter.Send(msg.TargetThreadID, &transmitter.Payload{
+		Username:  msg.Message.Author.Username,
+		AvatarURL: msg.Message.Author.AvatarURL,
+		Content:   ds.rewriteMentionsForDiscord(msg.Message.Body),
+	}, files); err != nil {
+		fmt.Println(err)
+	}
+}
 
-		payloadWriter, err := writer.CreateFormField("payload_json")
-		if err != nil {
-			log.Fatalln(err)
+// fetchAttachment returns a ready-to-upload file for a ChatPlug
+// attachment, downloading it from sourceURL. When ds.assetStore is
+// configured, a previous download for the same originID (e.g. the
+// original message an edit is re-sending) is served from disk instead of
+// being fetched again, and a fresh download is saved there for next time.
+func (ds *DiscordService) fetchAttachment(originID, sourceURL string) (*transmitter.File, error) {
+	if ds.assetStore != nil {
+		if record, ok := ds.assetStore.Lookup(originID); ok {
+			if local, err := os.Open(record.LocalPath); err == nil {
+				return &transmitter.File{
+					Name:        path.Base(record.LocalPath),
+					Reader:      local,
+					ContentType: record.ContentType,
+				}, nil
+			}
 		}
+	}
+
+	var buf bytes.Buffer
+	var dst io.Writer = &buf
 
-		_, err = payloadWriter.Write([]byte(payload))
+	var tmpFile *os.File
+	var hasher hash.Hash
+	if ds.assetStore != nil {
+		var err error
+		tmpFile, err = ioutil.TempFile(ds.assetStore.Dir(), "download-*")
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
+		hasher = sha256.New()
+		dst = io.MultiWriter(&buf, tmpFile, hasher)
+	}
 
-		fmt.Println("Wrote JSON payload")
-
-		for _, attachment := range msg.Message.Attachments {
-			filename := path.Base(attachment.SourceURL)
-
-			fileWriter, err := writer.CreateFormFile(filename, filename)
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			if err := DownloadFile(attachment.SourceURL, fileWriter); err != nil {
-				fmt.Println(err)
-				continue
-			}
+	contentType, err := DownloadFile(sourceURL, dst, maxAttachmentBytes)
+	if err != nil {
+		if tmpFile != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
 		}
+		return nil, err
+	}
 
-		fmt.Println("Wrote attachments")
+	filename := path.Base(sourceURL)
 
-		writer.Close()
+	if tmpFile != nil {
+		tmpFile.Close()
 
-		req, err := http.NewRequest("POST", url, &body)
-		if err != nil {
-			fmt.Println(err)
-		}
-		// We need to set the content type from the writer, it includes necessary boundary as well
-		req.Header.Set("Content-Type", writer.FormDataContentType())
+		checksum := hex.EncodeToString(hasher.Sum(nil))
+		localPath := filepath.Join(ds.assetStore.Dir(), checksum+path.Ext(filename))
 
-		fmt.Println("Sending the request")
-		// Do the request
-		client := &http.Client{}
-		response, err := client.Do(req)
-		if err != nil {
+		if err := os.Rename(tmpFile.Name(), localPath); err != nil {
 			fmt.Println(err)
-		}
-
-		fmt.Println("Got response")
-		if response.StatusCode != 204 && response.StatusCode != 200 {
-			data, err := ioutil.ReadAll(response.Body)
-			if err != nil {
-				fmt.Println(err)
-			}
-			fmt.Println(data)
+		} else {
+			ds.assetStore.Put(AssetRecord{
+				OriginID:    originID,
+				LocalPath:   localPath,
+				ContentType: contentType,
+				Checksum:    checksum,
+			})
 		}
 	}
+
+	return &transmitter.File{Name: filename, Reader: &buf, ContentType: contentType}, nil
 }
 
 func (ds *DiscordService) Startup(args []string) {
@@ -140,10 +212,46 @@ func (ds *DiscordService) Startup(args []string) {
 		log.Fatal(err)
 	}
 
-	ds.discordClient, err = discordgo.New("Bot " + serviceConfiguration.BotToken)
-	ds.discordClient.AddHandler(ds.discordMessageCreate)
+	botMode := serviceConfiguration.BotToken != ""
+	webhookMode := serviceConfiguration.WebhookURL != "" || len(serviceConfiguration.ThreadWebhookURLs) > 0
+
+	if !botMode && !webhookMode {
+		log.Fatal("discord-service: configure either botToken or webhookURL")
+	}
+
+	ds.userMemberMap = make(map[string]*discordgo.Member)
+	ds.nickMemberMap = make(map[string]*discordgo.Member)
+	ds.allowedGuildIDs = parseGuildIDs(serviceConfiguration.GuildIDs)
+	ds.suppressJoinPart = serviceConfiguration.SuppressJoinPart
+
+	if serviceConfiguration.StorageDir != "" {
+		ds.assetStore, err = NewAssetStore(serviceConfiguration.StorageDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if botMode {
+		ds.discordClient, err = discordgo.New("Bot " + serviceConfiguration.BotToken)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ds.discordClient.AddHandler(ds.discordMessageCreate)
+		ds.discordClient.AddHandler(ds.discordGuildCreate)
+		ds.discordClient.AddHandler(ds.discordGuildMembersChunk)
+
+		_ = ds.discordClient.Open()
+	}
+
+	ds.transmitter = transmitter.New(ds.discordClient, 256)
+
+	if serviceConfiguration.WebhookURL != "" {
+		ds.registerStaticWebhook("", serviceConfiguration.WebhookURL)
+	}
+	for threadID, webhookURL := range serviceConfiguration.ThreadWebhookURLs {
+		ds.registerStaticWebhook(threadID, webhookURL)
+	}
 
-	_ = ds.discordClient.Open()
 	ds.client.SubscribeToSearchRequests()
 
 	go func() {
@@ -151,8 +259,17 @@ func (ds *DiscordService) Startup(args []string) {
 	}()
 
 	for searchRequest := range ds.client.SearchRequestsChan {
+		if !botMode {
+			ds.client.SetSearchResponse(searchRequest.Query, []*client.SearchThreadInput{})
+			continue
+		}
+
 		threadResults := make([]*client.SearchThreadInput, 0)
 		for _, guild := range ds.discordClient.State.Guilds {
+			if !ds.guildAllowed(guild.ID) {
+				continue
+			}
+
 			channels, _ := ds.discordClient.GuildChannels(guild.ID)
 			for _, channel := range channels {
 				if len(threadResults) < 30 && (strings.Contains(channel.Name, searchRequest.Query) || strings.Contains(guild.Name, searchRequest.Query)) && channel.Type == discordgo.ChannelTypeGuildText {
@@ -168,12 +285,47 @@ func (ds *DiscordService) Startup(args []string) {
 	}
 }
 
+// registerStaticWebhook parses webhookURL and hands it to the transmitter,
+// either as the default webhook (threadID == "") or bound to a specific
+// thread. It fails startup loudly if the URL is malformed or turns out to
+// be bound to a different channel than threadID expects.
+func (ds *DiscordService) registerStaticWebhook(threadID, webhookURL string) {
+	id, token, err := transmitter.ParseWebhookURL(webhookURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	channelID, err := transmitter.ResolveWebhookChannel(id, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if threadID == "" {
+		ds.transmitter.SetDefaultWebhook(&transmitter.StaticWebhook{ID: id, Token: token, ChannelID: channelID})
+		return
+	}
+
+	if channelID != threadID {
+		log.Fatalf("discord-service: webhook for thread %s actually points at channel %s", threadID, channelID)
+	}
+
+	ds.transmitter.SetChannelWebhook(threadID, &transmitter.StaticWebhook{ID: id, Token: token, ChannelID: channelID})
+}
+
 func (ds *DiscordService) discordMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 	// Ignore all messages created by the bot itself
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
 
+	if !ds.guildAllowed(m.GuildID) {
+		return
+	}
+
+	if ds.suppressJoinPart && isJoinPartMessage(m.Type) {
+		return
+	}
+
 	webhook, err := ds.discordClient.Webhook(m.WebhookID)
 	if err == nil && webhook != nil {
 		if strings.HasPrefix(webhook.Name, "ChatPlug ") {
@@ -193,8 +345,16 @@ func (ds *DiscordService) discordMessageCreate(s *discordgo.Session, m *discordg
 		attachments = append(attachments, &attachment)
 	}
 
+	embedText, embedAttachments := renderEmbeds(m.Embeds)
+	attachments = append(attachments, embedAttachments...)
+
+	content, mentionAttachments := ds.resolveDiscordContent(m.GuildID, m.Content)
+	attachments = append(attachments, mentionAttachments...)
+
+	content = ds.quotedReplyPrefix(m) + content + embedText
+
 	ds.client.SendMessage(
-		m.Content,
+		content,
 		m.ID,
 		m.ChannelID,
 		m.Author.Username,
@@ -204,6 +364,25 @@ func (ds *DiscordService) discordMessageCreate(s *discordgo.Session, m *discordg
 	)
 }
 
+// discordGuildCreate requests the member list for a newly-seen guild so
+// that GuildMembersChunk can populate userMemberMap/nickMemberMap, used to
+// rewrite ChatPlug "@name" mentions back into Discord mentions.
+func (ds *DiscordService) discordGuildCreate(s *discordgo.Session, g *discordgo.GuildCreate) {
+	_ = s.RequestGuildMembers(g.ID, "", 0, "", false)
+}
+
+func (ds *DiscordService) discordGuildMembersChunk(s *discordgo.Session, e *discordgo.GuildMembersChunk) {
+	ds.memberMapMu.Lock()
+	defer ds.memberMapMu.Unlock()
+
+	for _, member := range e.Members {
+		ds.userMemberMap[member.User.Username] = member
+		if member.Nick != "" {
+			ds.nickMemberMap[member.Nick] = member
+		}
+	}
+}
+
 func (ds *DiscordService) GetConfigurationSchema() []client.ConfigurationField {
 	conf := make([]client.ConfigurationField, 0)
 	ques1 := client.ConfigurationField{
@@ -211,10 +390,46 @@ func (ds *DiscordService) GetConfigurationSchema() []client.ConfigurationField {
 		Name:         "botToken",
 		Hint:         "Your Discord bot token",
 		DefaultValue: "",
-		Optional:     false,
+		Optional:     true,
 		Mask:         true,
 	}
 	conf = append(conf, ques1)
+	ques2 := client.ConfigurationField{
+		Type:         "STRING",
+		Name:         "webhookURL",
+		Hint:         "A pre-created Discord webhook URL (only needed if the bot can't be granted Manage Webhooks)",
+		DefaultValue: "",
+		Optional:     true,
+		Mask:         true,
+	}
+	conf = append(conf, ques2)
+	ques3 := client.ConfigurationField{
+		Type:         "STRING",
+		Name:         "guildIDs",
+		Hint:         "Comma-separated guild IDs to bridge (leave empty to allow every guild the bot is in)",
+		DefaultValue: "",
+		Optional:     true,
+		Mask:         false,
+	}
+	conf = append(conf, ques3)
+	ques4 := client.ConfigurationField{
+		Type:         "BOOLEAN",
+		Name:         "suppressJoinPart",
+		Hint:         "Drop Discord's member join/leave system messages instead of forwarding them",
+		DefaultValue: "false",
+		Optional:     true,
+		Mask:         false,
+	}
+	conf = append(conf, ques4)
+	ques5 := client.ConfigurationField{
+		Type:         "STRING",
+		Name:         "storageDir",
+		Hint:         "Directory to cache downloaded attachments in, so re-sent attachments aren't re-downloaded (leave empty to disable)",
+		DefaultValue: "",
+		Optional:     true,
+		Mask:         false,
+	}
+	conf = append(conf, ques5)
 	return conf
 }
 
@@ -240,8 +455,17 @@ func (ds *DiscordService) SaveConfiguration(conf []client.ConfigurationFieldResu
 	confStruct := DiscordServiceConfiguration{}
 
 	for _, field := range conf {
-		if field.Name == "botToken" {
+		switch field.Name {
+		case "botToken":
 			confStruct.BotToken = field.Value
+		case "webhookURL":
+			confStruct.WebhookURL = field.Value
+		case "guildIDs":
+			confStruct.GuildIDs = field.Value
+		case "suppressJoinPart":
+			confStruct.SuppressJoinPart = field.Value == "true"
+		case "storageDir":
+			confStruct.StorageDir = field.Value
 		}
 	}
 
@@ -257,26 +481,54 @@ func (ds *DiscordService) IsConfigured() bool {
 	return true
 }
 
-func DownloadFile(url string, dst io.Writer) error {
-	filename := path.Base(url)
+const maxAttachmentBytes = 8 * 1024 * 1024
 
-	head, err := http.Head(url)
-	if err != nil {
-		return err
-	}
-	if head.ContentLength > (8 * 1024 * 1024) {
-		return fmt.Errorf("File %s too big", filename)
-	}
+// sniffBytes is how much of the body DownloadFile buffers before handing it
+// to http.DetectContentType - many CDNs serve attachments at a URL with no
+// file extension, so the Content-Type has to come from the bytes.
+const sniffBytes = 512
 
-	// https://golangcode.com/download-a-file-from-a-url/
+// DownloadFile streams url into dst, stopping with an error once the body
+// turns out to be longer than maxBytes rather than trusting Content-Length (which chunked
+// responses omit, and which some servers report incorrectly). It returns
+// the content type detected from the first sniffBytes of the body.
+func DownloadFile(url string, dst io.Writer, maxBytes int64) (string, error) {
 	resp, err := http.Get(url)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(dst, resp.Body)
-	return err
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading %s: unexpected status %d", url, resp.StatusCode)
+	}
+
+	sniff := make([]byte, sniffBytes)
+	n, err := io.ReadFull(resp.Body, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	sniff = sniff[:n]
+	contentType := http.DetectContentType(sniff)
+
+	if _, err := dst.Write(sniff); err != nil {
+		return "", err
+	}
+
+	remaining := maxBytes - int64(n)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	written, err := io.CopyN(dst, resp.Body, remaining+1)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if err == nil && written == remaining+1 {
+		return "", fmt.Errorf("file at %s exceeds the %d byte limit", url, maxBytes)
+	}
+
+	return contentType, nil
 }
 
 func main() {
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGuildIDs(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want map[string]bool
+	}{
+		{
+			name: "empty",
+			raw:  "",
+			want: map[string]bool{},
+		},
+		{
+			name: "single",
+			raw:  "123",
+			want: map[string]bool{"123": true},
+		},
+		{
+			name: "comma separated with whitespace",
+			raw:  "123, 456 ,789",
+			want: map[string]bool{"123": true, "456": true, "789": true},
+		},
+		{
+			name: "ignores empty entries",
+			raw:  "123,,456,",
+			want: map[string]bool{"123": true, "456": true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseGuildIDs(tt.raw)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGuildIDs(%q) = %v; want %v", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuildAllowedEmptyAllowlistAllowsEverything(t *testing.T) {
+	ds := &DiscordService{}
+
+	if !ds.guildAllowed("any-guild") {
+		t.Error("guildAllowed with an empty allowlist should allow every guild")
+	}
+}
+
+func TestGuildAllowedRespectsAllowlist(t *testing.T) {
+	ds := &DiscordService{allowedGuildIDs: parseGuildIDs("123,456")}
+
+	if !ds.guildAllowed("123") {
+		t.Error("guildAllowed(\"123\") = false; want true")
+	}
+	if ds.guildAllowed("789") {
+		t.Error("guildAllowed(\"789\") = true; want false")
+	}
+}
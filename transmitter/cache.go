@@ -0,0 +1,69 @@
+package transmitter
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// webhookCache is a small LRU cache of the "ChatPlug " webhook for a
+// channel, so a hot channel doesn't hit ChannelWebhooks on every message.
+type webhookCache struct {
+	mu       sync.Mutex
+	capacity int
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type webhookCacheEntry struct {
+	channelID string
+	webhook   *discordgo.Webhook
+}
+
+func newWebhookCache(capacity int) *webhookCache {
+	if capacity <= 0 {
+		capacity = 128
+	}
+
+	return &webhookCache{
+		capacity: capacity,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *webhookCache) get(channelID string) (*discordgo.Webhook, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[channelID]
+	if !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*webhookCacheEntry).webhook, true
+}
+
+func (c *webhookCache) set(channelID string, webhook *discordgo.Webhook) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[channelID]; ok {
+		c.order.MoveToFront(elem)
+		elem.Value.(*webhookCacheEntry).webhook = webhook
+		return
+	}
+
+	elem := c.order.PushFront(&webhookCacheEntry{channelID: channelID, webhook: webhook})
+	c.items[channelID] = elem
+
+	if c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.items, oldest.Value.(*webhookCacheEntry).channelID)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package transmitter
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestWebhookCacheGetSet(t *testing.T) {
+	c := newWebhookCache(2)
+
+	if _, ok := c.get("a"); ok {
+		t.Fatal("get on empty cache returned a hit")
+	}
+
+	c.set("a", &discordgo.Webhook{ID: "wh-a"})
+	webhook, ok := c.get("a")
+	if !ok || webhook.ID != "wh-a" {
+		t.Fatalf("get(%q) = %v, %v; want wh-a, true", "a", webhook, ok)
+	}
+}
+
+func TestWebhookCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newWebhookCache(2)
+
+	c.set("a", &discordgo.Webhook{ID: "wh-a"})
+	c.set("b", &discordgo.Webhook{ID: "wh-b"})
+
+	// Touch "a" so "b" becomes the least recently used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("get(\"a\") missed before eviction")
+	}
+
+	c.set("c", &discordgo.Webhook{ID: "wh-c"})
+
+	if _, ok := c.get("b"); ok {
+		t.Fatal("\"b\" should have been evicted as the least recently used entry")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("\"a\" should still be cached")
+	}
+	if _, ok := c.get("c"); !ok {
+		t.Fatal("\"c\" should still be cached")
+	}
+}
+
+func TestWebhookCacheSetUpdatesExistingEntry(t *testing.T) {
+	c := newWebhookCache(2)
+
+	c.set("a", &discordgo.Webhook{ID: "wh-a"})
+	c.set("a", &discordgo.Webhook{ID: "wh-a-2"})
+
+	webhook, ok := c.get("a")
+	if !ok || webhook.ID != "wh-a-2" {
+		t.Fatalf("get(%q) = %v, %v; want wh-a-2, true", "a", webhook, ok)
+	}
+	if c.order.Len() != 1 {
+		t.Fatalf("order.Len() = %d; want 1 (re-set of an existing key shouldn't grow the list)", c.order.Len())
+	}
+}
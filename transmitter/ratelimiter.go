@@ -0,0 +1,123 @@
+package transmitter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter wraps an http.Client, tracking Discord's per-route buckets so
+// a channel that's about to be rate limited waits instead of burning the
+// whole application's quota. Routes are identified by the caller (the
+// webhook ID is enough granularity for our traffic).
+type rateLimiter struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	remaining int
+	resetAt   time.Time
+}
+
+type retryAfterBody struct {
+	RetryAfter float64 `json:"retry_after"`
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		client:  &http.Client{},
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// do performs the request built by newRequest, honoring the remembered
+// bucket state for key and transparently retrying once on a 429 (with a
+// second request from newRequest) using the `retry_after` Discord reports
+// in the response body.
+func (r *rateLimiter) do(key string, newRequest func() (*http.Request, error)) (*http.Response, []byte, error) {
+	r.waitForBucket(key)
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp, nil, err
+	}
+
+	r.updateBucket(key, resp)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		var body retryAfterBody
+		if err := json.Unmarshal(data, &body); err == nil && body.RetryAfter > 0 {
+			time.Sleep(time.Duration(body.RetryAfter * float64(time.Second)))
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		resp, err = r.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return resp, nil, err
+		}
+
+		r.updateBucket(key, resp)
+	}
+
+	return resp, data, nil
+}
+
+func (r *rateLimiter) waitForBucket(key string) {
+	r.mu.Lock()
+	b, ok := r.buckets[key]
+	r.mu.Unlock()
+
+	if !ok || b.remaining > 0 {
+		return
+	}
+
+	if wait := time.Until(b.resetAt); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (r *rateLimiter) updateBucket(key string, resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+
+	resetAfter, err := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Reset-After"), 64)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	r.buckets[key] = &bucket{
+		remaining: remaining,
+		resetAt:   time.Now().Add(time.Duration(resetAfter * float64(time.Second))),
+	}
+	r.mu.Unlock()
+}
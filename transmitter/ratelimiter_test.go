@@ -0,0 +1,102 @@
+package transmitter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpdateBucketRecordsRemainingAndResetAt(t *testing.T) {
+	r := newRateLimiter()
+
+	header := http.Header{}
+	header.Set("X-RateLimit-Remaining", "3")
+	header.Set("X-RateLimit-Reset-After", "1.5")
+	resp := &http.Response{Header: header}
+
+	before := time.Now()
+	r.updateBucket("hook-1", resp)
+
+	b, ok := r.buckets["hook-1"]
+	if !ok {
+		t.Fatal("updateBucket didn't record a bucket for the key")
+	}
+	if b.remaining != 3 {
+		t.Errorf("remaining = %d; want 3", b.remaining)
+	}
+
+	wantResetAt := before.Add(1500 * time.Millisecond)
+	if b.resetAt.Before(wantResetAt.Add(-50*time.Millisecond)) || b.resetAt.After(wantResetAt.Add(50*time.Millisecond)) {
+		t.Errorf("resetAt = %v; want ~%v", b.resetAt, wantResetAt)
+	}
+}
+
+func TestUpdateBucketIgnoresMissingHeaders(t *testing.T) {
+	r := newRateLimiter()
+
+	r.updateBucket("hook-1", &http.Response{Header: http.Header{}})
+
+	if _, ok := r.buckets["hook-1"]; ok {
+		t.Fatal("updateBucket recorded a bucket despite missing rate-limit headers")
+	}
+}
+
+func TestWaitForBucketDoesNotBlockWithQuotaRemaining(t *testing.T) {
+	r := newRateLimiter()
+	r.buckets["hook-1"] = &bucket{remaining: 1, resetAt: time.Now().Add(time.Hour)}
+
+	done := make(chan struct{})
+	go func() {
+		r.waitForBucket("hook-1")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForBucket blocked despite remaining quota")
+	}
+}
+
+func TestWaitForBucketBlocksUntilReset(t *testing.T) {
+	r := newRateLimiter()
+	r.buckets["hook-1"] = &bucket{remaining: 0, resetAt: time.Now().Add(100 * time.Millisecond)}
+
+	start := time.Now()
+	r.waitForBucket("hook-1")
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("waitForBucket returned after %v; want at least 100ms", elapsed)
+	}
+}
+
+func TestDoRetriesOn429(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"retry_after": 0.01}`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	r := newRateLimiter()
+	resp, _, err := r.do("hook-1", func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != nil {
+		t.Fatalf("do() returned error: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("final status = %d; want 200", resp.StatusCode)
+	}
+	if attempts != 2 {
+		t.Errorf("attempts = %d; want 2 (one 429 then one retry)", attempts)
+	}
+}
@@ -0,0 +1,74 @@
+package transmitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// StaticWebhook is a webhook supplied directly via configuration (id and
+// token parsed out of a Discord webhook URL) rather than discovered or
+// created through the bot API. ChannelID is filled in by
+// ResolveWebhookChannel so webhookFor can still catch a webhook pointed at
+// the wrong channel.
+type StaticWebhook struct {
+	ID        string
+	Token     string
+	ChannelID string
+}
+
+// ParseWebhookURL splits a Discord webhook URL of the form
+// https://discord.com/api/webhooks/<id>/<token> into its id and token.
+func ParseWebhookURL(rawURL string) (id, token string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return "", "", fmt.Errorf("%q doesn't look like a Discord webhook URL", rawURL)
+	}
+
+	return parts[len(parts)-2], parts[len(parts)-1], nil
+}
+
+// ResolveWebhookChannel asks Discord which channel a webhook posts to,
+// using only the public id/token route so it works without a bot session -
+// needed to validate operator-supplied webhook URLs in webhook-only mode.
+func ResolveWebhookChannel(id, token string) (string, error) {
+	url := fmt.Sprintf("https://discordapp.com/api/webhooks/%s/%s", id, token)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not resolve webhook %s: %s", id, data)
+	}
+
+	var info struct {
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", err
+	}
+
+	return info.ChannelID, nil
+}
+
+func (hook *StaticWebhook) asDiscordWebhook() *discordgo.Webhook {
+	return &discordgo.Webhook{ID: hook.ID, Token: hook.Token, ChannelID: hook.ChannelID}
+}
@@ -0,0 +1,54 @@
+package transmitter
+
+import "testing"
+
+func TestParseWebhookURL(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		wantID    string
+		wantToken string
+		wantErr   bool
+	}{
+		{
+			name:      "discord.com",
+			url:       "https://discord.com/api/webhooks/123456789/abcDEF-token",
+			wantID:    "123456789",
+			wantToken: "abcDEF-token",
+		},
+		{
+			name:      "discordapp.com with trailing slash",
+			url:       "https://discordapp.com/api/webhooks/123456789/abcDEF-token/",
+			wantID:    "123456789",
+			wantToken: "abcDEF-token",
+		},
+		{
+			name:    "too few path segments",
+			url:     "https://discord.com/123456789",
+			wantErr: true,
+		},
+		{
+			name:    "not a URL",
+			url:     "://not a url",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, token, err := ParseWebhookURL(tt.url)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseWebhookURL(%q) = nil error, want an error", tt.url)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseWebhookURL(%q) returned error: %v", tt.url, err)
+			}
+			if id != tt.wantID || token != tt.wantToken {
+				t.Errorf("ParseWebhookURL(%q) = %q, %q; want %q, %q", tt.url, id, token, tt.wantID, tt.wantToken)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Package transmitter owns everything involved in getting a message onto a
+// Discord channel via a webhook: finding or creating the webhook, staying
+// within Discord's rate limits, and making sure a slow/stuck channel can't
+// hold up every other channel. It is modeled after matterbridge's
+// transmitter of the same name.
+package transmitter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Payload is the subset of a Discord webhook execute payload we fill in.
+type Payload struct {
+	Content   string `json:"content"`
+	Username  string `json:"username,omitempty"`
+	AvatarURL string `json:"avatar_url,omitempty"`
+}
+
+// File is a single attachment to upload alongside a Payload. ContentType,
+// if set, is sent as the multipart part's Content-Type so Discord renders
+// images/videos inline instead of as a generic download.
+type File struct {
+	Name        string
+	Reader      io.Reader
+	ContentType string
+}
+
+// Transmitter posts ChatPlug messages to Discord through per-channel
+// webhooks, caching the webhooks it finds/creates and serializing the work
+// for each channel onto its own goroutine so one slow channel never blocks
+// another. session may be nil when running in webhook-only mode, in which
+// case every channel must be served by a static webhook (see
+// SetDefaultWebhook/SetChannelWebhook).
+type Transmitter struct {
+	session *discordgo.Session
+	cache   *webhookCache
+	limiter *rateLimiter
+
+	mu                      sync.Mutex
+	workers                 map[string]chan func()
+	defaultWebhook          *StaticWebhook
+	staticWebhooksByChannel map[string]*StaticWebhook
+}
+
+// New builds a Transmitter backed by session, caching up to cacheSize
+// channel webhooks at a time. session may be nil; see Transmitter.
+func New(session *discordgo.Session, cacheSize int) *Transmitter {
+	return &Transmitter{
+		session:                 session,
+		cache:                   newWebhookCache(cacheSize),
+		limiter:                 newRateLimiter(),
+		workers:                 make(map[string]chan func()),
+		staticWebhooksByChannel: make(map[string]*StaticWebhook),
+	}
+}
+
+// SetDefaultWebhook registers a statically-configured webhook used for any
+// channel without its own SetChannelWebhook override, and when no bot
+// session is available at all. hook.ChannelID, if set, is enforced against
+// the channel a message is actually addressed to.
+func (t *Transmitter) SetDefaultWebhook(hook *StaticWebhook) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.defaultWebhook = hook
+}
+
+// SetChannelWebhook registers a statically-configured webhook to use for
+// channelID, bypassing webhook discovery/creation through the bot API
+// entirely.
+func (t *Transmitter) SetChannelWebhook(channelID string, hook *StaticWebhook) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.staticWebhooksByChannel[channelID] = hook
+}
+
+// Send posts payload (and any files) to channelID's webhook, returning the
+// created Discord message.
+func (t *Transmitter) Send(channelID string, payload *Payload, files []*File) (*discordgo.Message, error) {
+	var message *discordgo.Message
+	var sendErr error
+
+	t.run(channelID, func() {
+		webhook, err := t.webhookFor(channelID)
+		if err != nil {
+			sendErr = err
+			return
+		}
+
+		body, contentType, err := encodeMultipart(payload, files)
+		if err != nil {
+			sendErr = err
+			return
+		}
+
+		url := fmt.Sprintf("https://discordapp.com/api/webhooks/%s/%s?wait=true", webhook.ID, webhook.Token)
+		resp, data, err := t.limiter.do(webhook.ID, func() (*http.Request, error) {
+			req, err := http.NewRequest("POST", url, bytes.NewReader(body.Bytes()))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", contentType)
+			return req, nil
+		})
+		if err != nil {
+			sendErr = err
+			return
+		}
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			sendErr = fmt.Errorf("discord webhook POST failed with status %d: %s", resp.StatusCode, data)
+			return
+		}
+
+		message = &discordgo.Message{}
+		sendErr = json.Unmarshal(data, message)
+	})
+
+	return message, sendErr
+}
+
+// webhookFor returns the webhook to post channelID's messages through: a
+// static per-channel override, the cached/discovered "ChatPlug " webhook,
+// or the default static webhook. The default webhook is checked before
+// falling back to bot-based discovery regardless of whether a bot session
+// is available - an operator running bot+webhook together (bot for
+// reading/search, webhookURL because the bot can't be granted Manage
+// Webhooks) needs the static webhook used even though t.session is
+// non-nil.
+func (t *Transmitter) webhookFor(channelID string) (*discordgo.Webhook, error) {
+	t.mu.Lock()
+	staticHook, hasStaticHook := t.staticWebhooksByChannel[channelID]
+	defaultHook := t.defaultWebhook
+	t.mu.Unlock()
+
+	if hasStaticHook {
+		return staticHook.asDiscordWebhook(), nil
+	}
+
+	if webhook, ok := t.cache.get(channelID); ok {
+		return webhook, nil
+	}
+
+	if defaultHook != nil && (defaultHook.ChannelID == "" || defaultHook.ChannelID == channelID) {
+		return defaultHook.asDiscordWebhook(), nil
+	}
+
+	if t.session == nil {
+		if defaultHook == nil {
+			return nil, fmt.Errorf("no webhook configured for channel %s and no bot session available", channelID)
+		}
+		return nil, fmt.Errorf("configured webhook posts to channel %s, not %s", defaultHook.ChannelID, channelID)
+	}
+
+	webhooks, err := t.session.ChannelWebhooks(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hook := range webhooks {
+		if strings.HasPrefix(hook.Name, "ChatPlug ") {
+			t.cache.set(channelID, hook)
+			return hook, nil
+		}
+	}
+
+	channel, err := t.session.Channel(channelID)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := t.session.WebhookCreate(channelID, "ChatPlug "+channel.Name, "https://i.imgur.com/l2QP9Go.png")
+	if err != nil {
+		return nil, err
+	}
+
+	t.cache.set(channelID, webhook)
+	return webhook, nil
+}
+
+// run serializes job onto the single worker goroutine for channelID,
+// lazily starting that goroutine on first use, and blocks until job has
+// run so callers can treat Send as a synchronous call. Send is the only
+// operation the Transmitter offers; it has no Edit or Delete.
+func (t *Transmitter) run(channelID string, job func()) {
+	done := make(chan struct{})
+
+	t.workerChan(channelID) <- func() {
+		job()
+		close(done)
+	}
+
+	<-done
+}
+
+func (t *Transmitter) workerChan(channelID string) chan func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ch, ok := t.workers[channelID]; ok {
+		return ch
+	}
+
+	ch := make(chan func(), 32)
+	t.workers[channelID] = ch
+
+	go func() {
+		for job := range ch {
+			job()
+		}
+	}()
+
+	return ch
+}
+
+func encodeMultipart(payload *Payload, files []*File) (*bytes.Buffer, string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", err
+	}
+
+	payloadWriter, err := writer.CreateFormField("payload_json")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := payloadWriter.Write(payloadJSON); err != nil {
+		return nil, "", err
+	}
+
+	for _, file := range files {
+		fileWriter, err := createFormFile(writer, file.Name, file.Name, file.ContentType)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := io.Copy(fileWriter, file.Reader); err != nil {
+			return nil, "", err
+		}
+		if closer, ok := file.Reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+
+	return &body, writer.FormDataContentType(), nil
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// createFormFile is multipart.Writer.CreateFormFile, but lets us set the
+// part's actual Content-Type instead of always getting
+// application/octet-stream.
+func createFormFile(w *multipart.Writer, fieldname, filename, contentType string) (io.Writer, error) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, quoteEscaper.Replace(fieldname), quoteEscaper.Replace(filename)))
+	header.Set("Content-Type", contentType)
+
+	return w.CreatePart(header)
+}
@@ -0,0 +1,42 @@
+package transmitter
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestWebhookForPrefersChannelOverrideThenDefaultThenBot(t *testing.T) {
+	tr := New(nil, 16)
+	tr.SetDefaultWebhook(&StaticWebhook{ID: "default", Token: "tok", ChannelID: "chan-default"})
+	tr.SetChannelWebhook("chan-override", &StaticWebhook{ID: "override", Token: "tok"})
+
+	webhook, err := tr.webhookFor("chan-override")
+	if err != nil || webhook.ID != "override" {
+		t.Fatalf("webhookFor(chan-override) = %v, %v; want override, nil", webhook, err)
+	}
+
+	webhook, err = tr.webhookFor("chan-default")
+	if err != nil || webhook.ID != "default" {
+		t.Fatalf("webhookFor(chan-default) = %v, %v; want default, nil", webhook, err)
+	}
+
+	if _, err := tr.webhookFor("chan-unknown"); err == nil {
+		t.Fatal("webhookFor(chan-unknown) = nil error; want an error (no session, no matching static webhook)")
+	}
+}
+
+// TestWebhookForUsesDefaultEvenWithBotSession guards the precedence bug the
+// reviewer flagged: an operator running bot+webhookURL together needs the
+// static default webhook honored for its channel even though a (non-nil)
+// bot session is also configured, instead of falling through to
+// session.ChannelWebhooks/WebhookCreate.
+func TestWebhookForUsesDefaultEvenWithBotSession(t *testing.T) {
+	tr := New(&discordgo.Session{}, 16)
+	tr.SetDefaultWebhook(&StaticWebhook{ID: "default", Token: "tok", ChannelID: "chan-default"})
+
+	webhook, err := tr.webhookFor("chan-default")
+	if err != nil || webhook.ID != "default" {
+		t.Fatalf("webhookFor(chan-default) = %v, %v; want default, nil", webhook, err)
+	}
+}